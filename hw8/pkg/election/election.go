@@ -0,0 +1,307 @@
+/*
+ * Copyright © 2019 University of California, Berkeley
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package election implements a simple lease-and-heartbeat leader election
+// over the same journal.Journal abstraction the tpc package already uses for
+// durable state, modeled loosely on etcd's concurrency.Election API.
+package election
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Berkeley-CS162/tpc/pkg/journal"
+	"github.com/golang/glog"
+)
+
+// LEASE_TTL is how long a campaigning peer's heartbeat is considered live.
+// A peer that has not renewed its entry within LEASE_TTL is presumed dead,
+// and any watching peer may re-campaign in its place.
+const LEASE_TTL = 3 * time.Second
+
+// entry is a single peer's bid for leadership: its name, a monotonic
+// sequence number assigned at campaign time (lower wins), and the last time
+// it renewed its heartbeat.
+type entry struct {
+	Name     string
+	Sequence uint64
+	LastSeen time.Time
+}
+
+// Election runs leader election for a single named peer against a
+// quorum-replicated journal shared by every peer in the cluster. The peer
+// with the smallest live sequence number in the journal is the leader;
+// losing peers watch the leader's heartbeat and re-campaign on timeout.
+//
+// NOTE: Election assumes journal is backed by an RPC journal.Journal
+// implementation that every peer appends to and reads from, so that a
+// smallest-live-sequence comparison is consistent across the cluster.
+type Election struct {
+	name    string
+	journal journal.Journal
+	mux     sync.Mutex
+	seq     uint64
+	leading bool
+	cancel  context.CancelFunc
+	// lost is closed by renewLeadership when e stops leading, whether
+	// because Resign was called, a heartbeat failed to journal, or another
+	// peer won a later least-sequence comparison. It is replaced each time
+	// Campaign wins, so callers must fetch it via Done after Campaign
+	// returns rather than caching it across elections.
+	lost chan struct{}
+}
+
+// NewElection creates an Election for a peer named name, participating
+// through the given shared journal.
+func NewElection(name string, journal journal.Journal) *Election {
+	return &Election{name: name, journal: journal}
+}
+
+// Campaign registers name's bid for leadership and blocks until it becomes
+// the leader (i.e. until it holds the smallest live sequence number) or ctx
+// is cancelled. val is an opaque value associated with the bid, following
+// the etcd concurrency.Election convention, and is not currently interpreted
+// by Election itself.
+func (e *Election) Campaign(ctx context.Context, val string) error {
+	e.mux.Lock()
+	e.seq++
+	seq := e.seq
+	e.mux.Unlock()
+
+	if err := e.heartbeat(val); err != nil {
+		return fmt.Errorf("error appending campaign entry for %s: %v", e.name, err)
+	}
+
+	ticker := time.NewTicker(LEASE_TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		leaderName, leaderSeq, err := e.leastSequence()
+		if err != nil {
+			return fmt.Errorf("error scanning election journal: %v", err)
+		}
+		if leaderName == e.name && leaderSeq == seq {
+			renewCtx, cancel := context.WithCancel(context.Background())
+			lost := make(chan struct{})
+			e.mux.Lock()
+			e.leading = true
+			e.cancel = cancel
+			e.lost = lost
+			e.mux.Unlock()
+			glog.Infof("peer %s won the election with sequence %d", e.name, seq)
+			go e.renewLeadership(renewCtx, val, seq, lost)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			// renew our own heartbeat so other peers don't presume us dead
+			// while we wait for the current leader's lease to expire
+			if err := e.heartbeat(val); err != nil {
+				glog.Errorf("peer %s failed to renew campaign heartbeat: %v", e.name, err)
+			}
+		}
+	}
+}
+
+// renewLeadership keeps e's heartbeat renewed on a LEASE_TTL/3 ticker for as
+// long as e is leading, so leastSequence never sees the winning entry go
+// stale and hand leadership to a second peer while e still believes it is
+// leading. It also re-checks leastSequence on every tick: if e no longer
+// holds the win (e.g. a network partition let another peer's bid through),
+// it steps e down itself instead of leaving e to find out the hard way.
+// renewLeadership returns, closing lost, when ctx is cancelled (by Resign)
+// or when it detects leadership is no longer e's.
+func (e *Election) renewLeadership(ctx context.Context, val string, seq uint64, lost chan struct{}) {
+	defer close(lost)
+
+	ticker := time.NewTicker(LEASE_TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.heartbeat(val); err != nil {
+				glog.Errorf("peer %s failed to renew leadership heartbeat, stepping down: %v", e.name, err)
+				e.stepDown()
+				return
+			}
+			leaderName, leaderSeq, err := e.leastSequence()
+			if err != nil {
+				glog.Errorf("error scanning election journal while leading: %v", err)
+				continue
+			}
+			if leaderName != e.name || leaderSeq != seq {
+				glog.Warningf("peer %s lost leadership to %s, stepping down", e.name, leaderName)
+				e.stepDown()
+				return
+			}
+		}
+	}
+}
+
+// stepDown marks e as no longer leading, without touching the journal;
+// callers that are renouncing leadership voluntarily should use Resign
+// instead, which also appends the tombstone that lets other peers take over
+// immediately rather than waiting out the lease.
+func (e *Election) stepDown() {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.leading = false
+}
+
+// Done returns the channel that closes when e's current term as leader ends,
+// whether through Resign, a failed heartbeat, or another peer's bid winning
+// a later comparison. It is only meaningful after Campaign has returned
+// successfully, and must be re-fetched after every win since each term gets
+// its own channel.
+func (e *Election) Done() <-chan struct{} {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.lost
+}
+
+// heartbeat appends a liveness entry for e's own campaign, stamping it with
+// the current time so leastSequence can tell a crashed peer's stale bid
+// apart from one that is still renewing on schedule.
+func (e *Election) heartbeat(val string) error {
+	return e.journal.Append(journal.Entry{
+		Key:    e.name,
+		Value:  fmt.Sprintf("%d|%s", time.Now().UnixNano(), val),
+		Action: 0,
+	})
+}
+
+// Resign steps down from leadership, allowing another campaigning peer to
+// win the next time it checks the journal.
+func (e *Election) Resign(ctx context.Context) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if !e.leading {
+		return nil
+	}
+	e.leading = false
+	if e.cancel != nil {
+		e.cancel()
+	}
+	glog.Infof("peer %s resigned leadership", e.name)
+	// appending a sentinel with Action set lets leastSequence treat this
+	// peer's bid as withdrawn without needing a separate tombstone column
+	return e.journal.Append(journal.Entry{Key: e.name, Action: -1})
+}
+
+// Observe streams the name of the current leader to the returned channel
+// whenever it changes, so peers such as a TPCPeer can rewire their
+// MessageManager.clients list to point at the new leader.
+func (e *Election) Observe(ctx context.Context) <-chan string {
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		var last string
+		ticker := time.NewTicker(LEASE_TTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				leader, _, err := e.leastSequence()
+				if err != nil {
+					glog.Errorf("error observing election journal: %v", err)
+					continue
+				}
+				if leader != "" && leader != last {
+					last = leader
+					select {
+					case out <- leader:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// leastSequence scans the shared election journal and returns the name and
+// sequence number of the peer with the smallest live sequence number, where
+// "live" means not withdrawn (no trailing tombstone) and heartbeating within
+// LEASE_TTL. A peer whose most recent entry is older than LEASE_TTL is
+// presumed crashed, exactly like one that explicitly Resign()ed, so its bid
+// is dropped rather than winning forever.
+func (e *Election) leastSequence() (string, uint64, error) {
+	entryIterator := e.journal.NewIterator()
+	live := map[string]entry{}
+	var seq uint64
+
+	for {
+		journalEntry, err := entryIterator.Next()
+		if err != nil {
+			break
+		}
+		if journalEntry.Action == -1 {
+			delete(live, journalEntry.Key)
+			continue
+		}
+		seq++
+		lastSeen, err := parseHeartbeat(journalEntry.Value)
+		if err != nil {
+			glog.Errorf("election journal entry for %s has malformed heartbeat: %v", journalEntry.Key, err)
+			continue
+		}
+		if prev, ok := live[journalEntry.Key]; ok {
+			// a renewed heartbeat keeps the sequence of the peer's first entry
+			// since its last tombstone, so renewing never changes its rank
+			prev.LastSeen = lastSeen
+			live[journalEntry.Key] = prev
+			continue
+		}
+		live[journalEntry.Key] = entry{Name: journalEntry.Key, Sequence: seq, LastSeen: lastSeen}
+	}
+
+	var winner string
+	var winnerSeq uint64
+	for name, candidate := range live {
+		if time.Since(candidate.LastSeen) > LEASE_TTL {
+			// the peer hasn't renewed its heartbeat within the lease, so
+			// treat its bid as dead rather than letting a crashed process
+			// win the election forever
+			continue
+		}
+		if winner == "" || candidate.Sequence < winnerSeq {
+			winner = name
+			winnerSeq = candidate.Sequence
+		}
+	}
+	return winner, winnerSeq, nil
+}
+
+// parseHeartbeat extracts the timestamp a heartbeat entry was appended at,
+// from the "<unixnano>|<val>" encoding heartbeat uses.
+func parseHeartbeat(value string) (time.Time, error) {
+	var unixNano int64
+	if _, err := fmt.Sscanf(value, "%d|", &unixNano); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, unixNano), nil
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright © 2019 University of California, Berkeley
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tpc
+
+import (
+	"context"
+	"fmt"
+
+	tpc_pb "github.com/Berkeley-CS162/tpc/pkg/rpc"
+	"github.com/golang/glog"
+)
+
+// KV is a single key-value mutation within a Commit call. Unlike Put, which
+// only ever touches one key through the vote/global path, Commit accepts a
+// batch of mutations that must all take effect atomically across followers.
+type KV struct {
+	Key   string
+	Value string
+}
+
+// lockStatus describes the outcome of consulting a transaction's primary
+// lock, which is how a reader or a secondary follower learns whether a
+// pending transaction ultimately committed.
+type lockStatus int
+
+const (
+	lockStatusPending   lockStatus = iota // the primary is still being prewritten/committed
+	lockStatusCommitted                   // the primary committed; secondaries can roll forward
+	lockStatusAborted                     // the primary aborted; secondaries can clean up
+)
+
+// Commit runs a Percolator-style two-phase write across the followers that
+// own the keys in mutations, so that either all of the mutations become
+// visible at a single commit timestamp or none of them do.
+//
+// The first mutation is used as the transaction's primary; its follower's
+// lock record is the source of truth that a reader or a recovering secondary
+// consults to resolve an in-doubt transaction. This mirrors how Put's single
+// key is implicitly its own primary, except here the decision must be
+// recorded once and observed consistently by every other participant.
+//
+// Unlike Put, Commit does not hold l.mux across the prewrite/commit RPCs:
+// nextTs's own locking is all the leader-side bookkeeping a Commit needs, so
+// multiple Commits (and Puts) can have their network round trips in flight at
+// once. Conflicting writes are serialized by each follower's per-key lock
+// (see Prewrite), not by a leader-wide mutex.
+func (l *TPCLeader) Commit(ctx context.Context, mutations []KV) error {
+	if len(mutations) == 0 {
+		return fmt.Errorf("commit requires at least one mutation")
+	}
+
+	startTs, err := l.nextTs()
+	if err != nil {
+		return fmt.Errorf("error allocating start ts: %v", err)
+	}
+
+	primary := mutations[0]
+	if err := l.prewrite(ctx, primary, primary, startTs); err != nil {
+		return fmt.Errorf("error prewriting primary: %v", err)
+	}
+
+	var prewritten []KV
+	for _, mutation := range mutations[1:] {
+		if err := l.prewrite(ctx, primary, mutation, startTs); err != nil {
+			// the primary (and every secondary already prewritten) is still
+			// locked in lockStatusPending; rollBack tells each of them to
+			// release that lock so resolvePrimary doesn't see a pending
+			// transaction forever
+			l.rollBack(ctx, primary, append(prewritten, primary), startTs)
+			return fmt.Errorf("error prewriting secondary %s: %v", mutation.Key, err)
+		}
+		prewritten = append(prewritten, mutation)
+	}
+
+	commitTs, err := l.nextTs()
+	if err != nil {
+		return fmt.Errorf("error allocating commit ts: %v", err)
+	}
+
+	// committing the primary is what makes the transaction durable: once this
+	// RPC succeeds, the transaction is considered committed even if every
+	// secondary commit below is lost and must be replayed by a reader
+	if err := l.commitKey(ctx, primary, primary.Key, startTs, commitTs); err != nil {
+		return fmt.Errorf("error committing primary: %v", err)
+	}
+
+	// secondaries are committed asynchronously: their lock records are only
+	// ever consulted through the primary, so losing one of these RPCs just
+	// means a future reader rolls the write forward itself
+	for _, mutation := range mutations[1:] {
+		go func(m KV) {
+			if err := l.commitKey(ctx, primary, m.Key, startTs, commitTs); err != nil {
+				glog.Errorf("tpc leader %s failed to commit secondary %s, will be rolled forward by readers: %v", l.name, m.Key, err)
+			}
+		}(mutation)
+	}
+
+	return nil
+}
+
+// nextTs allocates a timestamp from l.oracle, taking l.mux only for the
+// duration of the allocation rather than for the whole Commit call, since
+// TSOracle.Next is already internally synchronized and the mutex here is
+// purely about keeping l's own bookkeeping consistent, not about
+// serializing the network round trips that follow.
+func (l *TPCLeader) nextTs() (uint64, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.oracle.Next()
+}
+
+// broadcast sends msg to every follower and waits for all of them to
+// respond, returning an error if any refused. Percolator mutations go
+// through every follower rather than a single "responsible" one because
+// Get reads from a single randomly-chosen follower (see TPCLeader.Get) and
+// therefore assumes every follower already holds every key, exactly like
+// the single-key vote/global path keeps every follower's kvstore in sync.
+func (l *TPCLeader) broadcast(ctx context.Context, key string, msg tpc_pb.LeaderMsg) error {
+	responseChannel := l.manager.SendMessage(ctx, msg, false)
+	refused := false
+	numResponses := 0
+	for response := range responseChannel {
+		if response == nil || response.Action == tpc_pb.Action_ABORT {
+			refused = true
+		}
+		numResponses++
+		if numResponses == l.numFollowers {
+			break
+		}
+	}
+	if refused {
+		return fmt.Errorf("a follower refused %v for key %s", msg.Type, key)
+	}
+	return nil
+}
+
+// rollBack tells every follower to discard its startTs lock and prewritten
+// value for each of keys, so a prewrite failure partway through a
+// transaction doesn't leave an earlier key locked in lockStatusPending
+// forever. It is best-effort: a follower that never saw the lock in the
+// first place (the one whose prewrite just failed) has nothing to roll back.
+func (l *TPCLeader) rollBack(ctx context.Context, primary KV, keys []KV, startTs uint64) {
+	for _, mutation := range keys {
+		rollbackMessage := tpc_pb.LeaderMsg{
+			Type:    tpc_pb.MessageType_ROLLBACK,
+			Key:     mutation.Key,
+			Primary: primary.Key,
+			StartTs: startTs,
+		}
+		if err := l.broadcast(ctx, mutation.Key, rollbackMessage); err != nil {
+			glog.Errorf("tpc leader %s failed to roll back key %s at start_ts %d, will be resolved as aborted by readers: %v", l.name, mutation.Key, startTs, err)
+		}
+	}
+}
+
+// prewrite broadcasts a single key's prewrite to every follower.
+func (l *TPCLeader) prewrite(ctx context.Context, primary, mutation KV, startTs uint64) error {
+	prewriteMessage := tpc_pb.LeaderMsg{
+		Type:    tpc_pb.MessageType_PREWRITE,
+		Key:     mutation.Key,
+		Value:   mutation.Value,
+		Primary: primary.Key,
+		StartTs: startTs,
+	}
+	return l.broadcast(ctx, mutation.Key, prewriteMessage)
+}
+
+// commitKey broadcasts to every follower that key's start_ts lock should
+// become a durable, versioned write at commitTs.
+func (l *TPCLeader) commitKey(ctx context.Context, primary KV, key string, startTs, commitTs uint64) error {
+	commitMessage := tpc_pb.LeaderMsg{
+		Type:     tpc_pb.MessageType_COMMIT,
+		Key:      key,
+		Primary:  primary.Key,
+		StartTs:  startTs,
+		CommitTs: commitTs,
+	}
+	return l.broadcast(ctx, key, commitMessage)
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright © 2019 University of California, Berkeley
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/Berkeley-CS162/tpc/pkg/journal"
+	"github.com/golang/glog"
+)
+
+// InstallSnapshot ships a compact KV snapshot, plus the txnid it was taken
+// at, to followerName. It is used both to bring a freshly-provisioned
+// follower up to date and to catch up one that has fallen far enough behind
+// that replaying its journal would mean replaying unbounded history.
+//
+// NOTE: this method should only be called without l's mutex held, since it
+// may run for as long as it takes to stream the snapshot and must not block
+// other followers' vote/global traffic in the meantime.
+func (l *TPCLeader) InstallSnapshot(ctx context.Context, followerName string) error {
+	snapshot, snapshotTxnid, err := l.kvstore.Snapshot()
+	if err != nil {
+		return fmt.Errorf("error taking snapshot for follower %s: %v", followerName, err)
+	}
+	defer snapshot.Close()
+
+	client, err := l.manager.ClientFor(followerName)
+	if err != nil {
+		return fmt.Errorf("error finding client for follower %s: %v", followerName, err)
+	}
+
+	err = client.SendSnapshot(ctx, snapshot, snapshotTxnid)
+	if err != nil {
+		return fmt.Errorf("error streaming snapshot to follower %s: %v", followerName, err)
+	}
+
+	l.statsMux.Lock()
+	l.followerAcks[followerName] = snapshotTxnid
+	l.statsMux.Unlock()
+
+	glog.Infof("tpc leader %s installed snapshot at txnid %d on follower %s", l.name, snapshotTxnid, followerName)
+	return nil
+}
+
+// maybeInstallSnapshot triggers an asynchronous InstallSnapshot for any
+// follower whose acked txnid lags the leader's by more than MAX_LOG_SIZE
+// transactions, instead of letting Put block on a slow or disconnected
+// follower catching up one retransmission at a time. A follower that already
+// has an InstallSnapshot goroutine in flight is skipped, so a follower that
+// is down (rather than merely slow) doesn't accumulate a new
+// snapshot-streaming goroutine on every single Put.
+//
+// NOTE: followerAcks and snapshottingFollowers are read/written through
+// statsMux, not mux, since they are also touched by retryGlobalUntilAcked and
+// InstallSnapshot goroutines that run while the caller (Put) still holds mux.
+func (l *TPCLeader) maybeInstallSnapshot(ctx context.Context) {
+	l.statsMux.Lock()
+	lagging := map[string]uint64{}
+	for followerName, acked := range l.followerAcks {
+		if l.lastTxnid-acked > MAX_LOG_SIZE && !l.snapshottingFollowers[followerName] {
+			lagging[followerName] = acked
+			l.snapshottingFollowers[followerName] = true
+		}
+	}
+	l.statsMux.Unlock()
+
+	for followerName, acked := range lagging {
+		glog.Warningf("tpc leader %s follower %s is %d txns behind, triggering snapshot install", l.name, followerName, l.lastTxnid-acked)
+		go func(name string) {
+			defer func() {
+				l.statsMux.Lock()
+				delete(l.snapshottingFollowers, name)
+				l.statsMux.Unlock()
+			}()
+			if err := l.InstallSnapshot(l.bgCtx, name); err != nil {
+				glog.Errorf("tpc leader %s failed to install snapshot on follower %s: %v", l.name, name, err)
+			}
+		}(followerName)
+	}
+}
+
+// minAckedTxnid returns the lowest txnid acked by any follower, which is the
+// point up to which the leader's journal can safely be truncated: anything
+// after it might still be needed to bring a lagging follower up to date
+// through ordinary replay rather than a full snapshot.
+//
+// NOTE: followerAcks is read through statsMux, not mux, for the same reason
+// as in maybeInstallSnapshot.
+func (l *TPCLeader) minAckedTxnid() uint64 {
+	l.statsMux.Lock()
+	defer l.statsMux.Unlock()
+
+	min := l.lastTxnid
+	for _, acked := range l.followerAcks {
+		if acked < min {
+			min = acked
+		}
+	}
+	return min
+}
+
+// HandleSnapshot atomically replaces f's kvstore with the snapshot streamed
+// from the leader and truncates f's journal to the snapshot's txnid, so that
+// replaying the journal afterward only needs to re-apply transactions the
+// snapshot doesn't already reflect.
+func (f *TPCFollower) HandleSnapshot(ctx context.Context, snapshot io.Reader, snapshotTxnid uint64) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.kvstore.Restore(snapshot, snapshotTxnid); err != nil {
+		return fmt.Errorf("error restoring kvstore from snapshot: %v", err)
+	}
+	if err := f.journal.Truncate(snapshotTxnid); err != nil {
+		return fmt.Errorf("error truncating journal to snapshot txnid %d: %v", snapshotTxnid, err)
+	}
+
+	f.lastAckedTxnid = snapshotTxnid
+	f.pendingEntry = journal.Entry{}
+	f.state = TPC_INIT
+	glog.Infof("tpc follower %s installed snapshot at txnid %d", f.name, snapshotTxnid)
+	return nil
+}
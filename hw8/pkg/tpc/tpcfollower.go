@@ -44,6 +44,12 @@ type TPCFollower struct {
 	kvstore      kvstore.KVStore
 	state        tpcState
 	mux          sync.Mutex
+	// lastAckedTxnid is the txnid of the most recently completed single-key
+	// transaction; after a journal replay that ends in an unfinished
+	// transaction, it is that transaction's txnid. It lets global() tell a stale, already-applied GLOBAL
+	// message apart from one that is misordered or genuinely new, instead of
+	// only being able to recognize a retransmission while still TPC_READY.
+	lastAckedTxnid uint64
 }
 
 // TPCFollowerConfig sets up the TPCFollower
@@ -97,6 +103,7 @@ func (f *TPCFollower) replayJournal() error {
 	var entryIterator *journal.EntryIterator = f.journal.NewIterator()
 	var key, value string
 	var action tpc_pb.Action
+	var txnid uint64
 
 	for {
 		// terminate the loop when there's no more entry
@@ -110,7 +117,13 @@ func (f *TPCFollower) replayJournal() error {
 		  ignore the intermediate logs, until we arrive at the end of the journal
 		  and have fetched the latest state of the server
 		*/
-		key, value, action = entry.Key, entry.Value, entry.Action
+		key, value, action, txnid = entry.Key, entry.Value, entry.Action, entry.Txnid
+		// recover the highest observed txnid regardless of whether its entry
+		// is the terminal one, so a restarted follower never treats an id it
+		// has already seen as new
+		if entry.Txnid > f.lastAckedTxnid {
+			f.lastAckedTxnid = entry.Txnid
+		}
 	}
 
 	if action == tpc_pb.Action_ACK {
@@ -137,7 +150,7 @@ func (f *TPCFollower) replayJournal() error {
 			populated and its state changed to TPC_READY, to prepare for
 			the leader's global request.
 		*/
-		f.pendingEntry.Key, f.pendingEntry.Value, f.pendingEntry.Action = key, value, action
+		f.pendingEntry.Key, f.pendingEntry.Value, f.pendingEntry.Action, f.pendingEntry.Txnid = key, value, action, txnid
 		f.state = TPC_READY
 	}
 
@@ -145,6 +158,16 @@ func (f *TPCFollower) replayJournal() error {
 	return nil
 }
 
+// ErrStaleTxnid is returned by global when a GLOBAL message's txnid is less
+// than or equal to the txnid this follower already applied; the caller should treat it
+// as an idempotent no-op ack rather than an error.
+var ErrStaleTxnid = fmt.Errorf("txnid is stale")
+
+// ErrTxnidMismatch is returned by global when a GLOBAL message's txnid does
+// not match the pending transaction's txnid, which means the message is
+// either misordered or belongs to an operation this follower never voted on.
+var ErrTxnidMismatch = fmt.Errorf("txnid does not match pending transaction")
+
 // vote returns the action that f will perform on the given key-value pair.
 // It stores the key-value pair to f's pendingEntry field, and changes f's state
 // to TPC_READY. If either of these actions is not allowed, it returns
@@ -156,12 +179,12 @@ func (f *TPCFollower) replayJournal() error {
 //
 // NOTE: this method can only be called if the executing thread has acquired
 // the mutex lock of f.
-func (f *TPCFollower) vote(key, value string) (tpc_pb.Action, error) {
+func (f *TPCFollower) vote(key, value string, txnid uint64) (tpc_pb.Action, error) {
 	// the message might be a re-transmission if f is already in the ready state
 	if f.state == TPC_READY {
-		// if the message carries the same key and value as the pending KV pair,
-		// then return the same action as f promised last time
-		if key == f.pendingEntry.Key && value == f.pendingEntry.Value {
+		// if the message carries the same key, value and txnid as the pending
+		// KV pair, then return the same action as f promised last time
+		if key == f.pendingEntry.Key && value == f.pendingEntry.Value && txnid == f.pendingEntry.Txnid {
 			return f.pendingEntry.Action, nil
 
 			// otherwise, the leader has broken its guarantee and sent message for
@@ -177,6 +200,7 @@ func (f *TPCFollower) vote(key, value string) (tpc_pb.Action, error) {
 		Key:    key,
 		Value:  value,
 		Action: tpc_pb.Action_PREPARE,
+		Txnid:  txnid,
 	})
 	if err != nil {
 		return tpc_pb.Action_ABORT, err
@@ -197,6 +221,7 @@ func (f *TPCFollower) vote(key, value string) (tpc_pb.Action, error) {
 		Key:    key,
 		Value:  value,
 		Action: tpc_pb.Action_COMMIT,
+		Txnid:  txnid,
 	}
 	f.state = TPC_READY
 	return tpc_pb.Action_COMMIT, nil
@@ -206,27 +231,39 @@ func (f *TPCFollower) vote(key, value string) (tpc_pb.Action, error) {
 // If the action is commit, it persists the KV pair; if the action is abort, it
 // discards the KV pair.
 //
-// if global receives a re-transmitted message (e.g. the last response was lost),
-// then it skips the action and return directly.
+// txnid identifies which transaction action applies to. If f is TPC_INIT and
+// txnid is less than or equal to the last txnid this follower applied, the message is a retransmission of an
+// already-completed transaction and global returns ErrStaleTxnid as an
+// idempotent no-op ack. If f is TPC_READY but txnid doesn't match the pending
+// transaction, global returns ErrTxnidMismatch instead of silently acking or
+// killing the process, since the message is misordered or duplicated rather
+// than a retransmission of the current operation.
 //
 // NOTE: this method can only be called if the executing thread has acquired
 // the mutex lock on f.
-func (f *TPCFollower) global(action tpc_pb.Action) error {
-	// the message might be a re-transmission if f is already in the init state
+func (f *TPCFollower) global(action tpc_pb.Action, txnid uint64) error {
 	if f.state == TPC_INIT {
-		/*
-		  since the method has no access to the referenced KV pair (furthermore,
-		  the global message simply doesn't contain the KV pair), it cannot verify
-		  whether this global message is a re-transmission of the already-handled
-		  message. The only thing it can do is therefore to return early
-		*/
-		return nil
+		if txnid <= f.lastAckedTxnid {
+			// the leader is retransmitting a GLOBAL message for a transaction we
+			// already acked; treat it as an idempotent no-op rather than trying
+			// to re-derive whether it was handled from the (now absent) pending entry
+			return ErrStaleTxnid
+		}
+		// f never voted on this txnid (it's ahead of what we've acked and
+		// there's no pending entry to match it against), so this is a
+		// misordered or misdirected message, not a legitimate retransmission
+		glog.Errorf("tpc follower %s received global message for unknown txnid %d", f.name, txnid)
+		return ErrTxnidMismatch
+	} else if txnid != f.pendingEntry.Txnid {
+		glog.Errorf("tpc follower %s received global message for txnid %d while pending txnid %d", f.name, txnid, f.pendingEntry.Txnid)
+		return ErrTxnidMismatch
 	} else {
 		// log that the follower has received the global message
 		err := f.journal.Append(journal.Entry{
 			Key:    f.pendingEntry.Key,
 			Value:  f.pendingEntry.Value,
 			Action: action,
+			Txnid:  txnid,
 		})
 		if err != nil {
 			/*
@@ -267,18 +304,30 @@ func (f *TPCFollower) global(action tpc_pb.Action) error {
 			Key:    f.pendingEntry.Key,
 			Value:  f.pendingEntry.Value,
 			Action: tpc_pb.Action_ACK,
+			Txnid:  txnid,
 		})
 		if err != nil {
 			glog.Errorf("tpc follower %s failed to log to journal", f.name)
 			os.Exit(-1)
 		}
 
+		f.lastAckedTxnid = txnid
 		f.pendingEntry = journal.Entry{}
 		f.state = TPC_INIT
 		return nil
 	}
 }
 
+// LastAppliedTxnid returns the txnid of the most recently completed
+// single-key transaction, for external monitoring and consistency checks.
+// Right after a restart whose journal replay ended in an unfinished
+// transaction, it returns that pending transaction's txnid.
+func (f *TPCFollower) LastAppliedTxnid() uint64 {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.lastAckedTxnid
+}
+
 // Get returns the current value of a given key, if it exists.
 func (f *TPCFollower) Get(ctx context.Context, key string) (string, error) {
 	f.mux.Lock()
@@ -290,25 +339,200 @@ func (f *TPCFollower) Get(ctx context.Context, key string) (string, error) {
 	return val, nil
 }
 
+// GetAtTimestamp returns the value visible to a Percolator-style transaction
+// reading key as of readTs. If it finds a lock written before readTs, the
+// write it guards is still in doubt, so GetAtTimestamp must resolve it by
+// asking the primary's follower whether that transaction committed, rather
+// than returning a value the writer might still abort.
+func (f *TPCFollower) GetAtTimestamp(ctx context.Context, key string, readTs uint64) (string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	lock, found, err := f.kvstore.GetLock(key)
+	if err != nil {
+		return "", fmt.Errorf("error reading lock for key %s: %v", key, err)
+	}
+	if found && lock.StartTs <= readTs {
+		status, commitTs, err := f.resolvePrimary(ctx, lock.Primary, lock.StartTs)
+		if err != nil {
+			return "", fmt.Errorf("error resolving primary for key %s: %v", key, err)
+		}
+		switch status {
+		case lockStatusCommitted:
+			// the primary committed but this secondary never heard the async
+			// commit, so roll the write forward ourselves before reading
+			if err := f.rollForward(key, lock, commitTs); err != nil {
+				return "", fmt.Errorf("error rolling forward key %s: %v", key, err)
+			}
+		case lockStatusAborted:
+			if err := f.kvstore.DeleteLock(key); err != nil {
+				return "", fmt.Errorf("error cleaning up aborted lock for key %s: %v", key, err)
+			}
+			return "", fmt.Errorf("key %s was locked by an aborted transaction", key)
+		case lockStatusPending:
+			return "", fmt.Errorf("key %s is locked by an in-flight transaction", key)
+		}
+	}
+
+	return f.kvstore.GetVersion(key, readTs)
+}
+
+// resolvePrimary asks the follower responsible for the primary key whether
+// the transaction identified by startTs committed, aborted, or is still
+// pending, returning the transaction's real commit_ts when it committed so
+// that a caller rolling the write forward (see rollForward) stamps it at the
+// timestamp the transaction actually committed at, not an arbitrary one.
+// This is the mechanism that lets any secondary lock be resolved without a
+// central transaction manager: the primary's lock (or its absence, replaced
+// by a commit_ts record) is the single source of truth.
+//
+// NOTE: this is a placeholder for an RPC to the primary's follower; wiring it
+// up requires the leader to expose a key-to-follower lookup, which the
+// MessageManager already performs for routing PREWRITE/COMMIT messages.
+func (f *TPCFollower) resolvePrimary(ctx context.Context, primary string, startTs uint64) (lockStatus, uint64, error) {
+	if primary == "" {
+		return lockStatusAborted, 0, fmt.Errorf("lock has no primary to resolve")
+	}
+	// a transaction's own follower can answer locally without an RPC
+	lock, found, err := f.kvstore.GetLock(primary)
+	if err != nil {
+		return lockStatusPending, 0, err
+	}
+	if found && lock.StartTs == startTs {
+		// the primary is still locked by the very transaction we're resolving
+		return lockStatusPending, 0, nil
+	}
+	// either there's no lock on the primary, or it belongs to a different,
+	// later transaction; either way the one we're resolving already finished
+	// one way or another. CommitKey records a commit_ts keyed by startTs
+	// before it clears the lock, so its presence (and value) tells us both
+	// that the transaction committed and at what timestamp.
+	commitTs, err := f.kvstore.GetCommitTs(primary, startTs)
+	if err != nil {
+		return lockStatusAborted, 0, nil
+	}
+	return lockStatusCommitted, commitTs, nil
+}
+
+// rollForward copies a secondary's prewritten value into its durable,
+// versioned store at commitTs and releases the lock, on behalf of a
+// transaction whose primary has already committed at commitTs.
+func (f *TPCFollower) rollForward(key string, lock kvstore.Lock, commitTs uint64) error {
+	value, err := f.kvstore.GetVersion(key, lock.StartTs)
+	if err != nil {
+		return err
+	}
+	if err := f.kvstore.PutVersion(key, commitTs, value); err != nil {
+		return err
+	}
+	if err := f.kvstore.PutCommitTs(key, lock.StartTs, commitTs); err != nil {
+		return err
+	}
+	return f.kvstore.DeleteLock(key)
+}
+
+// Prewrite records a tentative write for a Percolator-style transaction. It
+// aborts if the key is already locked with a start_ts other than startTs;
+// committed writes newer than startTs are not checked.
+func (f *TPCFollower) Prewrite(ctx context.Context, primary, key, value string, startTs uint64) (tpc_pb.Action, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if lock, found, err := f.kvstore.GetLock(key); err != nil {
+		return tpc_pb.Action_ABORT, err
+	} else if found && lock.StartTs != startTs {
+		glog.Warningf("tpc follower %s found conflicting lock on key %s, aborting prewrite", f.name, key)
+		return tpc_pb.Action_ABORT, nil
+	}
+
+	if err := f.kvstore.PutVersion(key, startTs, value); err != nil {
+		return tpc_pb.Action_ABORT, err
+	}
+	if err := f.kvstore.PutLock(key, kvstore.Lock{Primary: primary, StartTs: startTs}); err != nil {
+		return tpc_pb.Action_ABORT, err
+	}
+	return tpc_pb.Action_COMMIT, nil
+}
+
+// Rollback discards a prewritten key's tentative value and releases its
+// lock, on behalf of a transaction that failed to prewrite every key. It is
+// a no-op if f never prewrote startTs for key, since a transaction's primary
+// prewrite can fail before any secondary ever saw the lock.
+func (f *TPCFollower) Rollback(ctx context.Context, key string, startTs uint64) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	lock, found, err := f.kvstore.GetLock(key)
+	if err != nil {
+		return err
+	}
+	if !found || lock.StartTs != startTs {
+		// either f never prewrote this transaction, or the lock already
+		// resolved (e.g. a concurrent commit won the race); nothing to do
+		return nil
+	}
+	if err := f.kvstore.DeleteVersion(key, startTs); err != nil {
+		return err
+	}
+	return f.kvstore.DeleteLock(key)
+}
+
+// CommitKey turns a prewritten key's lock into a durable write visible at
+// commitTs, records the commit_ts against startTs so a later resolvePrimary
+// can learn the real commit_ts instead of guessing, and releases the lock.
+func (f *TPCFollower) CommitKey(ctx context.Context, key string, startTs, commitTs uint64) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	lock, found, err := f.kvstore.GetLock(key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		// the commit may be a retransmission of one we already applied
+		return nil
+	}
+	if lock.StartTs != startTs {
+		return fmt.Errorf("tpc follower %s has no matching lock for key %s at start_ts %d", f.name, key, startTs)
+	}
+	value, err := f.kvstore.GetVersion(key, startTs)
+	if err != nil {
+		return err
+	}
+	if err := f.kvstore.PutVersion(key, commitTs, value); err != nil {
+		return err
+	}
+	if err := f.kvstore.PutCommitTs(key, startTs, commitTs); err != nil {
+		return err
+	}
+	return f.kvstore.DeleteLock(key)
+}
+
 // Put is not supported by the TPCFollower, as PUT requests must go through the leader.
 func (f *TPCFollower) Put(ctx context.Context, key, value string) error {
 	return fmt.Errorf("tpc follower %s cannot PUT", f.name)
 }
 
-// HandleMessage takes a message from the TPCLeader and either calls vote or global, depending on the message type.
-func (f *TPCFollower) HandleMessage(msgType tpc_pb.MessageType, action tpc_pb.Action, key, value string) (tpc_pb.Action, error) {
+// HandleMessage takes a message from the TPCLeader and either calls vote or
+// global, depending on the message type. txnid is the transaction id the
+// leader allocated for this message, see vote and global for how each uses it.
+func (f *TPCFollower) HandleMessage(msgType tpc_pb.MessageType, action tpc_pb.Action, key, value string, txnid uint64) (tpc_pb.Action, error) {
 	f.mux.Lock()
 	defer f.mux.Unlock()
 
 	if msgType == tpc_pb.MessageType_VOTE {
-		vote, err := f.vote(key, value)
+		vote, err := f.vote(key, value, txnid)
 		if err != nil {
 			glog.Errorf("Aborting: %v", err)
 			return tpc_pb.Action_ABORT, fmt.Errorf("error voting: %v", err)
 		}
 		return vote, nil
 	} else if msgType == tpc_pb.MessageType_GLOBAL {
-		err := f.global(action)
+		err := f.global(action, txnid)
+		if err == ErrStaleTxnid {
+			// an idempotent ack of an already-completed transaction
+			return tpc_pb.Action_ACK, nil
+		}
 		if err != nil {
 			return tpc_pb.Action_ABORT, fmt.Errorf("error commiting global: %v", err)
 		}
@@ -318,5 +542,10 @@ func (f *TPCFollower) HandleMessage(msgType tpc_pb.MessageType, action tpc_pb.Ac
 		}
 		return tpc_pb.Action_ACK, nil
 	}
+	// tpc_pb.MessageType_PREWRITE, tpc_pb.MessageType_COMMIT and
+	// tpc_pb.MessageType_ROLLBACK carry fields (Primary, StartTs, CommitTs)
+	// that this single-key signature can't pass through, so the
+	// MessageManager routes them directly to Prewrite, CommitKey and
+	// Rollback instead of through HandleMessage.
 	return tpc_pb.Action_ABORT, fmt.Errorf("invalid message type: %v", msgType)
 }
@@ -25,6 +25,7 @@ import (
 
 	api_pb "github.com/Berkeley-CS162/tpc/api"
 	"github.com/Berkeley-CS162/tpc/pkg/journal"
+	"github.com/Berkeley-CS162/tpc/pkg/kvstore"
 	tpc_pb "github.com/Berkeley-CS162/tpc/pkg/rpc"
 	"github.com/golang/glog"
 	"google.golang.org/grpc"
@@ -44,13 +45,67 @@ type TPCLeader struct {
 	mux          sync.Mutex
 	manager      *MessageManager
 	numFollowers int
+	// oracle hands out the start_ts/commit_ts pairs that Commit uses to stamp
+	// Percolator-style multi-key transactions; Put does not need it because a
+	// single-key 2PC transaction has no concurrent readers to order against.
+	oracle *TSOracle
+	// lastTxnid is the highest txnid this leader has allocated for the
+	// single-key vote/global path, recovered from the journal on restart so
+	// that a replay never reuses an id it already handed to a follower.
+	lastTxnid uint64
+	// lastCommittedTxnid is the txnid of the most recently completed
+	// single-key transaction, i.e. the one the ACK journal entry was written
+	// for. Unlike lastTxnid, which is bumped the instant Put allocates an id
+	// and before any follower has voted, this only advances once the
+	// transaction has actually finished, so it is comparable to a follower's
+	// lastAckedTxnid for consistency checks.
+	lastCommittedTxnid uint64
+	// kvstore mirrors every committed key so InstallSnapshot has an
+	// authoritative copy of the cluster's data to ship to a lagging or
+	// freshly-provisioned follower, without having to single out and trust
+	// one follower's copy over another's.
+	kvstore kvstore.KVStore
+	// statsMux guards followerAcks and inFlightRetries separately from mux,
+	// since retryGlobalUntilAcked's background goroutines must be able to
+	// update them while mux is still held by the Put that spawned them.
+	statsMux sync.Mutex
+	// followerAcks tracks the highest txnid each follower has acked, so Put
+	// can detect a follower that has fallen more than MAX_LOG_SIZE
+	// transactions behind and trigger a snapshot install for it, and so the
+	// journal can be truncated only up to the minimum acked txnid.
+	followerAcks map[string]uint64
+	// inFlightRetries counts the retryGlobalUntilAcked goroutines currently
+	// retrying a GLOBAL message against each follower, exposed via Stats so
+	// operators can tell a follower that's merely slow from one that never
+	// acks at all.
+	inFlightRetries map[string]int
+	// snapshottingFollowers tracks which followers already have an
+	// InstallSnapshot goroutine in flight, so maybeInstallSnapshot doesn't
+	// spawn another one on every Put while a follower is still lagging.
+	snapshottingFollowers map[string]bool
+	// commitQuorum is how many followers must ack a GLOBAL message before
+	// Put returns; the rest are caught up by retryGlobalUntilAcked running
+	// in the background.
+	commitQuorum int
+	// bgCtx bounds the lifetime of goroutines (retryGlobalUntilAcked's
+	// stragglers, InstallSnapshot) that keep running after the Put/Commit
+	// call that spawned them returns, so they don't outlive l itself. bgCancel
+	// cancels it; Close calls bgCancel so a demoted leader's background work
+	// stops instead of leaking across re-elections.
+	bgCtx    context.Context
+	bgCancel context.CancelFunc
 }
 
 // TPCLeaderConfig sets up the TPCLeader
 type TPCLeaderConfig struct {
-	Name        string
-	JournalPath string
-	Followers   []string
+	Name          string
+	JournalPath   string
+	Followers     []string
+	TSJournalPath string
+	KVStoreDir    string
+	// CommitQuorum is how many followers must ack a Put's global message
+	// before it returns. Defaults to a strict majority, ⌊N/2⌋+1, if zero.
+	CommitQuorum int
 }
 
 // NewTPCLeader takes a TPCLeaderConfig and creates the TPCLeader,
@@ -61,12 +116,34 @@ func NewTPCLeader(config TPCLeaderConfig) (*TPCLeader, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error creating fs journal for tpc leader %s: %v", config.Name, err)
 	}
+	tpcKVStore, err := kvstore.NewFSKVStore(config.KVStoreDir)
+	if err != nil {
+		return nil, fmt.Errorf("error creating fs kvstore for tpc leader %s: %v", config.Name, err)
+	}
+	bgCtx, bgCancel := context.WithCancel(context.Background())
 	leader := &TPCLeader{
-		name:    config.Name,
-		journal: tpcJournal,
+		name:                  config.Name,
+		journal:               tpcJournal,
+		kvstore:               tpcKVStore,
+		followerAcks:          map[string]uint64{},
+		inFlightRetries:       map[string]int{},
+		snapshottingFollowers: map[string]bool{},
+		bgCtx:                 bgCtx,
+		bgCancel:              bgCancel,
 	}
 	leader.manager = NewMessageManager(config.Followers)
 	leader.numFollowers = len(config.Followers)
+	for _, follower := range config.Followers {
+		leader.followerAcks[follower] = 0
+	}
+	leader.commitQuorum = config.CommitQuorum
+	if leader.commitQuorum == 0 {
+		leader.commitQuorum = leader.numFollowers/2 + 1
+	}
+	leader.oracle, err = NewTSOracle(config.TSJournalPath)
+	if err != nil {
+		return nil, fmt.Errorf("error creating ts oracle for tpc leader %s: %v", config.Name, err)
+	}
 	err = leader.replayJournal()
 	if err != nil {
 		return nil, fmt.Errorf("error replaying tpc leader %s's journal: %v", config.Name, err)
@@ -94,6 +171,7 @@ func (l *TPCLeader) replayJournal() error {
 	var entryIterator *journal.EntryIterator = l.journal.NewIterator()
 	var key, value string
 	var action tpc_pb.Action
+	var txnid uint64
 
 	for {
 		// terminate the loop when there's no more entry
@@ -107,7 +185,12 @@ func (l *TPCLeader) replayJournal() error {
 		  ignore the intermediate logs, until we arrive at the end of the journal
 		  and have fetched the latest state of the server
 		*/
-		key, value, action = entry.Key, entry.Value, entry.Action
+		key, value, action, txnid = entry.Key, entry.Value, entry.Action, entry.Txnid
+		// every journaled entry carries the txnid that was live when it was
+		// appended, so the highest one seen is the watermark to recover
+		if entry.Txnid > l.lastTxnid {
+			l.lastTxnid = entry.Txnid
+		}
 	}
 
 	if action == tpc_pb.Action_ACK {
@@ -116,6 +199,7 @@ func (l *TPCLeader) replayJournal() error {
 		  transaction, so nothing needs to be done. This condition is for logic
 		  control purpose
 		*/
+		l.lastCommittedTxnid = txnid
 	} else {
 		var ctx context.Context = context.Background()
 
@@ -126,13 +210,14 @@ func (l *TPCLeader) replayJournal() error {
 		  logging the global decision
 		*/
 		if action == tpc_pb.Action_PREPARE {
-			action = l.voteRequest(ctx, key, value)
+			action = l.voteRequest(ctx, key, value, txnid)
 
 			// log that the leader is sending the global message
 			err := l.journal.Append(journal.Entry{
 				Key:    key,
 				Value:  value,
 				Action: action,
+				Txnid:  txnid,
 			})
 			if err != nil {
 				return err
@@ -147,7 +232,7 @@ func (l *TPCLeader) replayJournal() error {
 			the previous state also needs to send global messages, so we do them
 			together here.
 		*/
-		l.globalRequest(ctx, action)
+		l.globalRequest(ctx, action, txnid)
 
 		// log that the leader has completed the operation transaction. At this point,
 		// all followers should have consistent state regarding this KV pair
@@ -155,15 +240,20 @@ func (l *TPCLeader) replayJournal() error {
 			Key:    key,
 			Value:  value,
 			Action: tpc_pb.Action_ACK,
+			Txnid:  txnid,
 		})
 		if err != nil {
 			return err
 		}
+		l.lastCommittedTxnid = txnid
 	}
 
 	glog.Infof("tpc leader %s finished replaying journal", l.name)
-	// since the leader has no incomplete transaction, the journal can be cleared
-	l.journal.Empty()
+	// since the leader has no incomplete transaction, the journal can be
+	// truncated up to what every follower has acked; followerAcks still holds
+	// 0 for every follower at this point during startup, so minAckedTxnid is
+	// 0 until acks recorded by Put's global messages raise it
+	l.journal.Truncate(l.minAckedTxnid())
 	return nil
 }
 
@@ -172,14 +262,19 @@ func (l *TPCLeader) replayJournal() error {
 // if any follower returns tpc_pb.Action_ABORT, an error, or the connection to
 // which encounters an error, a tpc_pb.Action_COMMIT will be returend.
 //
+// txnid identifies this transaction to the followers, so that a follower
+// receiving a retransmitted GLOBAL message can tell whether it matches the
+// operation it is still holding a vote for.
+//
 // NOTE: this method should only be called if the executing thread has acquired
 // the mutex lock in l the TPCLeader.
-func (l *TPCLeader) voteRequest(ctx context.Context, key, value string) tpc_pb.Action {
+func (l *TPCLeader) voteRequest(ctx context.Context, key, value string, txnid uint64) tpc_pb.Action {
 	voteMessage := tpc_pb.LeaderMsg{
 		Type:   tpc_pb.MessageType_VOTE,
 		Action: tpc_pb.Action_PREPARE,
 		Key:    key,
 		Value:  value,
+		Txnid:  txnid,
 	}
 	var responseChannel chan *tpc_pb.Response = l.manager.SendMessage(ctx, voteMessage, false)
 
@@ -201,35 +296,159 @@ func (l *TPCLeader) voteRequest(ctx context.Context, key, value string) tpc_pb.A
 	return vote
 }
 
-// globalRequest requests all followers to execute an operation. In case of any
-// errors, it retries until all followers reply the ACK.
+const (
+	GLOBAL_RETRY_INITIAL_BACKOFF = 10 * time.Millisecond
+	GLOBAL_RETRY_BACKOFF_MULT    = 2
+	GLOBAL_RETRY_MAX_BACKOFF     = 5 * time.Second
+)
+
+// globalRequest requests all followers to execute an operation, returning as
+// soon as CommitQuorum of them have acked rather than blocking on every
+// follower. Each follower is retried independently with a bounded
+// exponential backoff (starting at GLOBAL_RETRY_INITIAL_BACKOFF, doubling up
+// to GLOBAL_RETRY_MAX_BACKOFF) until it acks, so a single down follower no
+// longer hangs Put indefinitely. Stragglers that haven't acked by the time
+// quorum is reached keep retrying in the background.
+//
+// txnid identifies the transaction being finalized; a follower that has
+// already applied it should treat the message as an idempotent no-op ack
+// rather than re-applying it or erroring.
 //
 // NOTE: this method should only be called if the execuring thread has acquired
 // the mutext lock in l the TPCLeader.
-func (l *TPCLeader) globalRequest(ctx context.Context, action tpc_pb.Action) {
+func (l *TPCLeader) globalRequest(ctx context.Context, action tpc_pb.Action, txnid uint64) {
 	globalMessage := tpc_pb.LeaderMsg{
 		Type:   tpc_pb.MessageType_GLOBAL,
 		Action: action,
+		Txnid:  txnid,
 	}
-	responseChannel := l.manager.SendMessage(ctx, globalMessage, true)
 
-	var numResponses int = 0
-	for responsePtr := range responseChannel {
-		if responsePtr.Action == tpc_pb.Action_ABORT {
-			glog.Errorf("tpc leader %s received abort response for global message", l.name)
+	// retryGlobalUntilAcked runs past the point where globalRequest (and the
+	// Put/replayJournal call that triggered it) returns, reconciling
+	// stragglers in the background, so it must not inherit ctx: a caller's
+	// request-scoped context is cancelled the moment the caller returns,
+	// which would kill every straggler retry the instant quorum is reached.
+	// l.bgCtx is scoped to l's own lifetime instead, via bgCancel, which
+	// Close calls when this leader is demoted or shut down.
+	acked := make(chan string, l.numFollowers)
+	for _, follower := range l.manager.clients {
+		go l.retryGlobalUntilAcked(l.bgCtx, follower.name, globalMessage, txnid, acked)
+	}
+
+	numAcked := 0
+	for numAcked < l.commitQuorum {
+		select {
+		case <-acked:
+			numAcked++
+		case <-ctx.Done():
+			glog.Warningf("tpc leader %s gave up waiting for quorum on txnid %d: %v", l.name, txnid, ctx.Err())
+			return
 		}
-		// end the loop only when responses from all followers were received
-		numResponses++
-		if numResponses == l.numFollowers {
-			break
+	}
+	// quorum reached: the remaining followers' retryGlobalUntilAcked
+	// goroutines keep running in the background and will update
+	// followerAcks themselves once they succeed
+}
+
+// retryGlobalUntilAcked resends msg to followerName with exponential backoff
+// until it returns an ACK (or an idempotent stale-txnid no-op) or ctx is
+// cancelled, recording structured glog events at each retry so operators can
+// see which followers are falling behind.
+func (l *TPCLeader) retryGlobalUntilAcked(ctx context.Context, followerName string, msg tpc_pb.LeaderMsg, txnid uint64, acked chan<- string) {
+	l.statsMux.Lock()
+	l.inFlightRetries[followerName]++
+	l.statsMux.Unlock()
+	defer func() {
+		l.statsMux.Lock()
+		l.inFlightRetries[followerName]--
+		l.statsMux.Unlock()
+	}()
+
+	backoff := GLOBAL_RETRY_INITIAL_BACKOFF
+	for attempt := 0; ; attempt++ {
+		response, err := l.manager.SendGlobalToFollower(ctx, followerName, msg)
+		if err == nil && response.Action != tpc_pb.Action_ABORT {
+			l.statsMux.Lock()
+			l.followerAcks[followerName] = txnid
+			l.statsMux.Unlock()
+			glog.Infof("tpc leader %s got ack from follower %s for txnid %d after %d retries", l.name, followerName, txnid, attempt)
+			acked <- followerName
+			return
+		}
+		glog.Warningf("tpc leader %s retrying global message to follower %s for txnid %d (attempt %d): %v", l.name, followerName, txnid, attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= GLOBAL_RETRY_BACKOFF_MULT
+		if backoff > GLOBAL_RETRY_MAX_BACKOFF {
+			backoff = GLOBAL_RETRY_MAX_BACKOFF
 		}
 	}
 }
 
-// Get passes the get request to a random client.
+// FollowerStats describes what the leader currently knows about a single
+// follower's progress, for detecting a partitioned or lagging follower
+// before its backlog grows large enough to require a snapshot install.
+type FollowerStats struct {
+	LastAckedTxnid  uint64
+	InFlightRetries int
+	Lag             uint64
+}
+
+// Stats returns a snapshot of every follower's last-acked txnid, number of
+// in-flight retries, and estimated lag behind the leader.
+func (l *TPCLeader) Stats() map[string]FollowerStats {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.statsMux.Lock()
+	defer l.statsMux.Unlock()
+
+	stats := make(map[string]FollowerStats, len(l.followerAcks))
+	for name, acked := range l.followerAcks {
+		stats[name] = FollowerStats{
+			LastAckedTxnid:  acked,
+			InFlightRetries: l.inFlightRetries[name],
+			Lag:             l.lastTxnid - acked,
+		}
+	}
+	return stats
+}
+
+// upToDateFollowerHostname picks a follower known (via followerAcks) to have
+// applied at least through lastCommittedTxnid, instead of an arbitrary
+// random one. globalRequest only waits for commitQuorum followers before
+// Put returns, so quorum alone doesn't guarantee a uniformly random follower
+// has the most recent write; reading from one that followerAcks confirms is
+// caught up closes that gap. If none are known to be caught up (e.g. right
+// after a fresh election, before any follower has acked anything), it falls
+// back to a random follower rather than failing the read outright.
+func (l *TPCLeader) upToDateFollowerHostname() string {
+	l.mux.Lock()
+	watermark := l.lastCommittedTxnid
+	l.mux.Unlock()
+
+	l.statsMux.Lock()
+	var caughtUp []string
+	for _, client := range l.manager.clients {
+		if l.followerAcks[client.name] >= watermark {
+			caughtUp = append(caughtUp, client.hostname)
+		}
+	}
+	l.statsMux.Unlock()
+
+	if len(caughtUp) == 0 {
+		return l.manager.clients[rand.Intn(l.numFollowers)].hostname
+	}
+	return caughtUp[rand.Intn(len(caughtUp))]
+}
+
+// Get passes the get request to a client known to have acked at least
+// through the leader's last committed txnid.
 func (l *TPCLeader) Get(ctx context.Context, key string) (string, error) {
-	clientIndex := rand.Intn(l.numFollowers)
-	hostname := l.manager.clients[clientIndex].hostname
+	hostname := l.upToDateFollowerHostname()
 	newConnection, err := grpc.Dial(hostname, grpc.WithInsecure())
 	if err != nil {
 		return "", fmt.Errorf("error dialing GET follower: %v", err)
@@ -252,30 +471,47 @@ func (l *TPCLeader) Put(ctx context.Context, key, value string) error {
 	l.mux.Lock()
 	defer l.mux.Unlock()
 
+	// every operation gets its own txnid so followers can tell a
+	// retransmitted GLOBAL message apart from one belonging to a later
+	// operation, instead of relying on their local state alone
+	l.lastTxnid++
+	txnid := l.lastTxnid
+
 	// log that the leader is sending the vote message
 	err := l.journal.Append(journal.Entry{
 		Key:    key,
 		Value:  value,
 		Action: tpc_pb.Action_PREPARE,
+		Txnid:  txnid,
 	})
 	if err != nil {
 		return err
 	}
 
 	// ask all followers to vote, then ask them to execute the global decision
-	var vote tpc_pb.Action = l.voteRequest(ctx, key, value)
+	var vote tpc_pb.Action = l.voteRequest(ctx, key, value, txnid)
 
 	// log that the leader is sending the global message
 	err = l.journal.Append(journal.Entry{
 		Key:    key,
 		Value:  value,
 		Action: vote,
+		Txnid:  txnid,
 	})
 	if err != nil {
 		return err
 	}
 
-	l.globalRequest(ctx, vote)
+	l.globalRequest(ctx, vote, txnid)
+
+	if vote == tpc_pb.Action_COMMIT {
+		// mirror the committed write locally so InstallSnapshot always has an
+		// authoritative, up-to-date copy of the cluster's data to ship to a
+		// lagging or freshly-provisioned follower
+		if err := l.kvstore.Put(key, value); err != nil {
+			glog.Errorf("tpc leader %s failed to mirror committed write for key %s: %v", l.name, key, err)
+		}
+	}
 
 	// log that the leader has completed the operation transaction. At this point,
 	// all followers should have consistent state regarding this KV pair
@@ -283,13 +519,24 @@ func (l *TPCLeader) Put(ctx context.Context, key, value string) error {
 		Key:    key,
 		Value:  value,
 		Action: tpc_pb.Action_ACK,
+		Txnid:  txnid,
 	})
 	if err != nil {
 		return err
 	}
+	l.lastCommittedTxnid = txnid
+
+	// a follower whose ack lag has grown past MAX_LOG_SIZE transactions is
+	// caught up via a snapshot instead of blocking this Put on its replay
+	l.maybeInstallSnapshot(ctx)
 
+	// only the journal entries still needed to bring the most-lagging
+	// follower up to date through ordinary replay need to be kept; anything
+	// older than every follower's ack watermark is safe to discard
 	if l.journal.Size() > MAX_LOG_SIZE {
-		l.journal.Empty()
+		if err := l.journal.Truncate(l.minAckedTxnid()); err != nil {
+			glog.Errorf("tpc leader %s failed to truncate journal: %v", l.name, err)
+		}
 	}
 	if vote == tpc_pb.Action_ABORT {
 		return fmt.Errorf("PUT failed")
@@ -297,7 +544,29 @@ func (l *TPCLeader) Put(ctx context.Context, key, value string) error {
 	return nil
 }
 
+// LastAppliedTxnid returns the txnid of the most recently completed
+// single-key transaction, for external monitoring and consistency checks.
+// This tracks lastCommittedTxnid rather than lastTxnid so it is directly
+// comparable to a TPCFollower's LastAppliedTxnid: lastTxnid advances the
+// instant Put allocates an id, before any follower has voted, which would
+// make the leader look perpetually ahead even when the cluster is caught up.
+func (l *TPCLeader) LastAppliedTxnid() uint64 {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.lastCommittedTxnid
+}
+
+// Close stops every background goroutine l has spawned (retryGlobalUntilAcked
+// stragglers, InstallSnapshot) by cancelling l.bgCtx. Callers that demote a
+// TPCLeader (e.g. TPCPeer.demote, on losing an election) must call Close on
+// the outgoing instance before constructing a new one, so that background
+// work from a previous term doesn't keep running indefinitely across
+// re-elections.
+func (l *TPCLeader) Close() {
+	l.bgCancel()
+}
+
 // HandleMessage takes a message from the TPCLeader and returns an error.
-func (l *TPCLeader) HandleMessage(tpc_pb.MessageType, tpc_pb.Action, string, string) (tpc_pb.Action, error) {
+func (l *TPCLeader) HandleMessage(tpc_pb.MessageType, tpc_pb.Action, string, string, uint64) (tpc_pb.Action, error) {
 	return tpc_pb.Action_ABORT, fmt.Errorf("tpc leader can not handle TPC leader messages")
 }
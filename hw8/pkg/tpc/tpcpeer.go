@@ -0,0 +1,224 @@
+/*
+ * Copyright © 2019 University of California, Berkeley
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	api_pb "github.com/Berkeley-CS162/tpc/api"
+	"github.com/Berkeley-CS162/tpc/pkg/election"
+	"github.com/Berkeley-CS162/tpc/pkg/journal"
+	tpc_pb "github.com/Berkeley-CS162/tpc/pkg/rpc"
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+)
+
+// TPCPeer is a role-switching TPC server: it starts as a follower,
+// campaigns for leadership through pkg/election, and promotes or
+// demotes its underlying TPCLeader/TPCFollower as the cluster's leadership
+// changes. Put and Get transparently forward to whichever role is currently
+// active, so callers do not need to know whether this peer is leading.
+type TPCPeer struct {
+	name     string
+	election *election.Election
+	mux      sync.Mutex
+	leader   *TPCLeader
+	follower *TPCFollower
+	// observedLeader is the name of whichever peer Observe last reported as
+	// leading, so Put can proxy to it while this peer itself is not leading.
+	observedLeader string
+
+	leaderConfig   TPCLeaderConfig
+	followerConfig TPCFollowerConfig
+	// peerAddrs maps every peer's name (including this peer's own) to its
+	// client-facing hostname, so an observed leader's name can be resolved
+	// to an address to forward Put to.
+	peerAddrs map[string]string
+}
+
+// TPCPeerConfig sets up a TPCPeer. ElectionJournalPath must point to a
+// journal shared (e.g. via an RPC-backed journal.Journal) by every peer in
+// the cluster, since leadership is decided by comparing entries across
+// peers. PeerAddrs maps every peer's name to its client-facing hostname, so
+// a non-leading peer can resolve the observed leader's name to an address to
+// forward Put to.
+type TPCPeerConfig struct {
+	Name                string
+	ElectionJournalPath string
+	Leader              TPCLeaderConfig
+	Follower            TPCFollowerConfig
+	PeerAddrs           map[string]string
+}
+
+// NewTPCPeer creates a TPCPeer that has not yet campaigned for any role;
+// callers should invoke Run to begin participating in leader election.
+func NewTPCPeer(config TPCPeerConfig) (*TPCPeer, error) {
+	electionJournal, err := journal.NewFileJournal(config.ElectionJournalPath)
+	if err != nil {
+		return nil, fmt.Errorf("error creating election journal for tpc peer %s: %v", config.Name, err)
+	}
+	peer := &TPCPeer{
+		name:           config.Name,
+		election:       election.NewElection(config.Name, electionJournal),
+		leaderConfig:   config.Leader,
+		followerConfig: config.Follower,
+		peerAddrs:      config.PeerAddrs,
+	}
+	peer.follower, err = NewTPCFollower(config.Follower)
+	if err != nil {
+		return nil, fmt.Errorf("error creating tpc follower for tpc peer %s: %v", config.Name, err)
+	}
+	return peer, nil
+}
+
+// Run campaigns for leadership in the background and promotes/demotes the
+// peer as the result changes, until ctx is cancelled. It also watches
+// election.Observe so a non-leading peer always knows who to forward Put to.
+func (p *TPCPeer) Run(ctx context.Context) {
+	go p.watchLeader(ctx)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			if err := p.election.Campaign(ctx, p.name); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				glog.Errorf("tpc peer %s campaign error: %v", p.name, err)
+				continue
+			}
+			p.promote()
+			// block until ctx is cancelled or election.Done reports that this
+			// peer's term as leader has ended (Resign, a failed heartbeat, or
+			// another peer winning a later comparison), then demote and
+			// re-campaign rather than only ever waking up on ctx.Done
+			select {
+			case <-ctx.Done():
+				p.demote()
+				return
+			case <-p.election.Done():
+				glog.Warningf("tpc peer %s lost leadership, demoting and re-campaigning", p.name)
+				p.demote()
+			}
+		}
+	}()
+}
+
+// watchLeader keeps p.observedLeader up to date by consuming election.Observe
+// until ctx is cancelled, so Put can proxy to the current leader without
+// every non-leading peer having to scan the election journal itself.
+func (p *TPCPeer) watchLeader(ctx context.Context) {
+	for leaderName := range p.election.Observe(ctx) {
+		p.mux.Lock()
+		p.observedLeader = leaderName
+		p.mux.Unlock()
+	}
+}
+
+// promote switches p into the leader role, constructing a new TPCLeader
+// unless p already has one; demote discards the TPCLeader, so each term as
+// leader starts with a fresh instance.
+func (p *TPCPeer) promote() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.leader != nil {
+		return
+	}
+	newLeader, err := NewTPCLeader(p.leaderConfig)
+	if err != nil {
+		glog.Errorf("tpc peer %s failed to promote to leader: %v", p.name, err)
+		return
+	}
+	p.leader = newLeader
+	glog.Infof("tpc peer %s promoted to leader", p.name)
+}
+
+// demote releases p's leader role; the peer continues serving as a
+// follower, and observing peers will re-campaign for the vacated role.
+// It closes the outgoing TPCLeader so its background goroutines
+// (retryGlobalUntilAcked stragglers, InstallSnapshot) stop instead of
+// leaking across every re-election.
+func (p *TPCPeer) demote() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.leader != nil {
+		p.leader.Close()
+	}
+	p.leader = nil
+	glog.Infof("tpc peer %s demoted to follower", p.name)
+}
+
+// Put forwards to the active TPCLeader if this peer is leading, or proxies
+// to whichever peer election.Observe last reported as leading otherwise, so
+// callers do not need to know or track the current leader themselves.
+func (p *TPCPeer) Put(ctx context.Context, key, value string) error {
+	p.mux.Lock()
+	leader := p.leader
+	observedLeader := p.observedLeader
+	p.mux.Unlock()
+	if leader != nil {
+		return leader.Put(ctx, key, value)
+	}
+	if observedLeader == "" {
+		return fmt.Errorf("tpc peer %s does not know the current leader", p.name)
+	}
+	return p.putRemote(ctx, observedLeader, key, value)
+}
+
+// putRemote forwards a Put to the peer named leaderName over the
+// KeyValueAPI, following the same dial-per-call pattern TPCLeader.Get uses
+// to forward Get to a follower.
+func (p *TPCPeer) putRemote(ctx context.Context, leaderName, key, value string) error {
+	hostname, ok := p.peerAddrs[leaderName]
+	if !ok {
+		return fmt.Errorf("tpc peer %s has no known address for observed leader %s", p.name, leaderName)
+	}
+	connection, err := grpc.Dial(hostname, grpc.WithInsecure())
+	if err != nil {
+		return fmt.Errorf("error dialing observed leader %s: %v", leaderName, err)
+	}
+	defer connection.Close()
+	client := api_pb.NewKeyValueAPIClient(connection)
+	_, err = client.Put(ctx, &api_pb.PutRequest{Key: key, Value: value})
+	if err != nil {
+		return fmt.Errorf("error forwarding PUT to observed leader %s: %v", leaderName, err)
+	}
+	return nil
+}
+
+// Get forwards to the active TPCLeader if this peer is leading, or serves
+// directly from the local follower's kvstore otherwise.
+func (p *TPCPeer) Get(ctx context.Context, key string) (string, error) {
+	p.mux.Lock()
+	leader := p.leader
+	p.mux.Unlock()
+	if leader != nil {
+		return leader.Get(ctx, key)
+	}
+	return p.follower.Get(ctx, key)
+}
+
+// HandleMessage forwards to the active TPCFollower, since only followers
+// receive TPC leader messages.
+func (p *TPCPeer) HandleMessage(msgType tpc_pb.MessageType, action tpc_pb.Action, key, value string, txnid uint64) (tpc_pb.Action, error) {
+	return p.follower.HandleMessage(msgType, action, key, value, txnid)
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright © 2019 University of California, Berkeley
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tpc
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Berkeley-CS162/tpc/pkg/journal"
+	"github.com/golang/glog"
+)
+
+// TSOracle is a monotonically-increasing timestamp generator that the
+// TPCLeader uses to stamp the start and commit of every Percolator-style
+// transaction. It journals every timestamp it hands out so that a restarted
+// leader never reuses a timestamp it has already given to a client.
+//
+// NOTE: a single TSOracle is meant to back a single TPCLeader; it is not
+// itself replicated, so if the leader changes (see the election work tracked
+// separately) the new leader must recover the oracle's watermark from the
+// same journal before handing out new timestamps.
+type TSOracle struct {
+	journal journal.Journal
+	mux     sync.Mutex
+	ts      uint64
+}
+
+// NewTSOracle creates a TSOracle backed by a FileJournal at journalPath and
+// recovers its watermark from the highest timestamp previously journaled.
+func NewTSOracle(journalPath string) (*TSOracle, error) {
+	tsJournal, err := journal.NewFileJournal(journalPath)
+	if err != nil {
+		return nil, fmt.Errorf("error creating fs journal for ts oracle: %v", err)
+	}
+	oracle := &TSOracle{journal: tsJournal}
+	if err := oracle.recover(); err != nil {
+		return nil, fmt.Errorf("error recovering ts oracle: %v", err)
+	}
+	return oracle, nil
+}
+
+// recover scans the oracle's journal for the highest previously-allocated
+// timestamp, so that Next never hands out a timestamp the leader has already
+// promised to a client.
+//
+// NOTE: this method should only be called during NewTSOracle, before the
+// oracle is reachable by any other goroutine.
+func (o *TSOracle) recover() error {
+	if o.journal.Size() == 0 {
+		glog.Infof("ts oracle has no journal to replay")
+		return nil
+	}
+
+	entryIterator := o.journal.NewIterator()
+	var highest uint64
+	for {
+		entry, err := entryIterator.Next()
+		if err != nil {
+			break
+		}
+		// the oracle only ever journals its own watermark, encoded as the
+		// entry's Value; Key and Action are unused but kept so the entry
+		// reuses the same journal.Entry shape as the rest of the package
+		var ts uint64
+		if _, err := fmt.Sscanf(entry.Value, "%d", &ts); err == nil && ts > highest {
+			highest = ts
+		}
+	}
+	o.ts = highest
+	return nil
+}
+
+// Next allocates and returns the next timestamp, journaling it first so that
+// a crash between journaling and returning never causes a timestamp to be
+// reused.
+func (o *TSOracle) Next() (uint64, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	o.ts++
+	err := o.journal.Append(journal.Entry{Value: fmt.Sprintf("%d", o.ts)})
+	if err != nil {
+		o.ts--
+		return 0, fmt.Errorf("error journaling ts oracle watermark: %v", err)
+	}
+	return o.ts, nil
+}